@@ -3,6 +3,7 @@
 package httprequest
 
 import (
+	"bufio"
 	"bytes"
 	"context"
 	"encoding/json"
@@ -10,9 +11,19 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math/rand"
+	"mime"
+	"mime/multipart"
 	"net/http"
 	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
 )
 
 // Client for the request
@@ -20,6 +31,13 @@ type Client interface {
 	Do(*http.Request) (*http.Response, error)
 }
 
+// RoundTripFunc is the signature of a single step in the Middleware chain, matching Client.Do
+type RoundTripFunc func(*http.Request) (*http.Response, error)
+
+// Middleware wraps a RoundTripFunc with additional behavior, such as logging, tracing, auth token
+// refresh or metrics, without having to wrap the whole Client
+type Middleware func(next RoundTripFunc) RoundTripFunc
+
 // Builder carries all the data necessary to execute a http request
 type Builder struct {
 	// Context for the request
@@ -48,14 +66,46 @@ type Builder struct {
 	Encoder EncoderFunc
 	// Body has the body for the Builder
 	Body any
-	// Decoder has the decoder for the response
+	// BodyProvider, when set, takes precedence over Body and Encoder
+	// It is how Form, Multipart, JSON, XML and String build the request body
+	BodyProvider BodyProvider
+	// Decoder has the fallback decoder for the response, used when the response's Content-Type
+	// does not match any decoder registered in Decoders
 	Decoder DecoderFunc
+	// Decoders has the decoders used to parse the response, picked by the response's Content-Type
+	Decoders *DecoderRegistry
+	// Retry has the policy used to retry failed attempts
+	// Nil means Do performs a single attempt, as before
+	Retry RetryPolicy
+	// Middlewares wraps every call to Client.Do, outermost first
+	Middlewares []Middleware
+	// StreamDecoder has the decoder used by DoStream
+	// Nil means DoStream uses a LineDecoder
+	StreamDecoder StreamDecoder
+	// Limiter, when set, is waited on before dispatching the request, and again before every
+	// retry attempt
+	Limiter Limiter
+}
+
+// roundTrip sends req through the Middlewares chain, outermost first, down to Client.Do
+func (b *Builder) roundTrip(req *http.Request) (*http.Response, error) {
+	final := RoundTripFunc(b.Client.Do)
+	for i := len(b.Middlewares) - 1; i >= 0; i-- {
+		final = b.Middlewares[i](final)
+	}
+	return final(req)
 }
 
-//EncoderFunc encodes the Body
+// EncoderFunc encodes the Body
 type EncoderFunc func(any) ([]byte, error)
 
-//DecoderFunc decodes the http request
+// BodyProvider produces the reader used as the request body, plus the Content-Type it should be
+// sent with. An empty content type leaves whatever Content-Type header is already set untouched;
+// this is how JSON and XML, which set their header directly, compose with Multipart, which only
+// knows its boundary once the writer is built
+type BodyProvider func() (io.Reader, string, error)
+
+// DecoderFunc decodes the http request
 type DecoderFunc func([]byte, any) error
 
 // Option add optional values to the Builder
@@ -63,27 +113,29 @@ type Option func(*Builder)
 
 // NewBuilder a new Builder
 // Example:
-//		func reqBuilder(ctx context.Context, id string, body any) {
-//			builder := NewBuilder("http://my.host.com",
-//				Method(MethodPatch), // by default is GET
-//				Path("/path/:id"),
-//				Param("id", id),
-//				Query("myQuery", "someValue"),
-//				Header("Authorization", "myauth"),
-//				Body(body),
-//			)
-//		}
+//
+//	func reqBuilder(ctx context.Context, id string, body any) {
+//		builder := NewBuilder("http://my.host.com",
+//			Method(MethodPatch), // by default is GET
+//			Path("/path/:id"),
+//			Param("id", id),
+//			Query("myQuery", "someValue"),
+//			Header("Authorization", "myauth"),
+//			Body(body),
+//		)
+//	}
 func NewBuilder(host string, options ...Option) *Builder {
 	r := Builder{
-		Context: context.Background(),
-		Client:  http.DefaultClient,
-		Method:  http.MethodGet,
-		Host:    host,
-		Params:  make(map[string]string),
-		Headers: make(http.Header),
-		Queries: make(url.Values),
-		Encoder: json.Marshal,
-		Decoder: json.Unmarshal,
+		Context:  context.Background(),
+		Client:   http.DefaultClient,
+		Method:   http.MethodGet,
+		Host:     host,
+		Params:   make(map[string]string),
+		Headers:  make(http.Header),
+		Queries:  make(url.Values),
+		Encoder:  json.Marshal,
+		Decoder:  json.Unmarshal,
+		Decoders: NewDecoderRegistry(),
 	}
 	for _, o := range options {
 		o(&r)
@@ -101,12 +153,21 @@ func (b *Builder) Build() (*http.Request, error) {
 	base := fmt.Sprintf("%s%s", b.Host, p)
 
 	var body io.Reader
-	if b.Body != nil {
-		b, err := b.Encoder(b.Body)
+	var contentType string
+	switch {
+	case b.BodyProvider != nil:
+		r, ct, err := b.BodyProvider()
+		if err != nil {
+			return nil, err
+		}
+		body = r
+		contentType = ct
+	case b.Body != nil:
+		encoded, err := b.Encoder(b.Body)
 		if err != nil {
 			return nil, err
 		}
-		body = bytes.NewBuffer(b)
+		body = bytes.NewBuffer(encoded)
 	}
 
 	req, err := http.NewRequestWithContext(b.Context, b.Method, base, body)
@@ -115,6 +176,9 @@ func (b *Builder) Build() (*http.Request, error) {
 	}
 
 	req.Header = b.Headers
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
 	req.URL.RawQuery = b.Queries.Encode()
 
 	return req, nil
@@ -126,21 +190,78 @@ type Response[T any] struct {
 	Body             T
 	Err              error
 	OriginalResponse *http.Response
+	// Attempts is the amount of attempts performed to get this Response
+	// It is always at least 1, and only greater than 1 when a Retry policy is set
+	Attempts int
 }
 
 // Do performs a request and retrieves the response for the request
+// If b.Retry is set, Do re-builds and re-sends the request (re-serializing the body from b.Body)
+// until the policy gives up, b.Context is done, or a successful attempt is reached
 func Do[T any](b Builder) Response[T] {
-	request, err := b.Build()
-	if err != nil {
-		return Response[T]{
-			Err: err,
+	for attempt := 1; ; attempt++ {
+		if b.Limiter != nil {
+			if err := b.Limiter.Wait(b.Context); err != nil {
+				return Response[T]{
+					Err:      err,
+					Attempts: attempt,
+				}
+			}
+		}
+
+		request, err := b.Build()
+		if err != nil {
+			return Response[T]{
+				Err:      err,
+				Attempts: attempt,
+			}
+		}
+
+		response, doErr := b.roundTrip(request)
+
+		resp := responseFor[T](b, response, doErr, attempt)
+
+		if b.Retry == nil {
+			return resp
+		}
+
+		retry, delay := b.Retry.ShouldRetry(attempt, response, doErr)
+		if !retry {
+			return resp
+		}
+		if d, ok := retryAfter(response); ok {
+			delay = d
 		}
+
+		select {
+		case <-b.Context.Done():
+			resp.Err = b.Context.Err()
+			return resp
+		case <-time.After(delay):
+		}
+
+		// drain and close the body we're not returning so net/http can reuse the connection for
+		// the next attempt, same as client-go's rest.Request does between retries
+		drainAndClose(response)
+	}
+}
+
+// drainAndClose reads response to EOF and closes it
+// response is nil when the previous attempt failed before a response was received
+func drainAndClose(response *http.Response) {
+	if response == nil || response.Body == nil {
+		return
 	}
+	_, _ = io.Copy(io.Discard, response.Body)
+	_ = response.Body.Close()
+}
 
-	response, err := b.Client.Do(request)
-	if err != nil {
+// responseFor builds the Response for a single attempt, without deciding whether to retry
+func responseFor[T any](b Builder, response *http.Response, doErr error, attempt int) Response[T] {
+	if doErr != nil {
 		return Response[T]{
-			Err: err,
+			Err:      doErr,
+			Attempts: attempt,
 		}
 	}
 
@@ -149,30 +270,340 @@ func Do[T any](b Builder) Response[T] {
 		return Response[T]{
 			Status:           response.StatusCode,
 			OriginalResponse: response,
+			Attempts:         attempt,
 		}
 	}
 
-	body, err := ParseResponse[T](response, b.Decoder)
+	body, err := ParseResponse[T](response, b.Decoders, b.Decoder)
 
 	return Response[T]{
 		Status:           response.StatusCode,
 		Body:             body,
 		Err:              err,
 		OriginalResponse: response,
+		Attempts:         attempt,
 	}
 }
 
+// retryAfter reads the Retry-After header, as sent by well-behaved APIs on 429 and 503 responses,
+// and reports the delay it asks for. Only the delta-seconds form is supported
+func retryAfter(response *http.Response) (time.Duration, bool) {
+	if response == nil {
+		return 0, false
+	}
+	if response.StatusCode != http.StatusTooManyRequests && response.StatusCode != http.StatusServiceUnavailable {
+		return 0, false
+	}
+	v := response.Header.Get("Retry-After")
+	if v == "" {
+		return 0, false
+	}
+	seconds, err := strconv.Atoi(v)
+	if err != nil || seconds < 0 {
+		return 0, false
+	}
+	return time.Duration(seconds) * time.Second, true
+}
+
 // ParseResponse parses the response into a struct
-func ParseResponse[T any](r *http.Response, f DecoderFunc) (T, error) {
+// It picks the decoder registered in decoders for the response's Content-Type, falling back to
+// def when there is no Content-Type, no matching decoder, or decoders is nil
+func ParseResponse[T any](r *http.Response, decoders *DecoderRegistry, def DecoderFunc) (T, error) {
 	buf, _ := ioutil.ReadAll(r.Body)
 	r.Body = ioutil.NopCloser(bytes.NewBuffer(buf))
 
 	var body T
-	if len(buf) > 0 {
-		err := f(buf, &body)
-		return body, err
+	if len(buf) == 0 {
+		return body, nil
+	}
+
+	f := def
+	if decoders != nil {
+		if fn, ok := decoders.decoderFor(r.Header.Get("Content-Type")); ok {
+			f = fn
+		}
+	}
+	if f == nil {
+		return body, fmt.Errorf("httprequest: no decoder for Content-Type %q", r.Header.Get("Content-Type"))
+	}
+
+	err := f(buf, &body)
+	return body, err
+}
+
+// DecoderRegistry maps media types to the DecoderFunc used to decode a response whose
+// Content-Type matches
+type DecoderRegistry struct {
+	decoders map[string]DecoderFunc
+}
+
+// NewDecoderRegistry builds a DecoderRegistry preloaded with decoders for application/json,
+// application/xml and text/plain
+func NewDecoderRegistry() *DecoderRegistry {
+	reg := &DecoderRegistry{decoders: make(map[string]DecoderFunc)}
+	reg.RegisterDecoder("application/json", json.Unmarshal)
+	reg.RegisterDecoder("application/xml", xml.Unmarshal)
+	reg.RegisterDecoder("text/plain", decodeText)
+	return reg
+}
+
+func decodeText(data []byte, v any) error {
+	switch dst := v.(type) {
+	case *string:
+		*dst = string(data)
+		return nil
+	case *[]byte:
+		*dst = data
+		return nil
+	default:
+		return fmt.Errorf("httprequest: text/plain decoder needs a *string or *[]byte, got %T", v)
+	}
+}
+
+// RegisterDecoder registers fn as the decoder used for responses with the given media type
+func (reg *DecoderRegistry) RegisterDecoder(mediaType string, fn DecoderFunc) {
+	reg.decoders[mediaType] = fn
+}
+
+// MediaTypes returns every media type currently registered, in no particular order
+func (reg *DecoderRegistry) MediaTypes() []string {
+	types := make([]string, 0, len(reg.decoders))
+	for mt := range reg.decoders {
+		types = append(types, mt)
+	}
+	return types
+}
+
+// decoderFor looks up the decoder registered for contentType, ignoring any parameters such as
+// charset
+func (reg *DecoderRegistry) decoderFor(contentType string) (DecoderFunc, bool) {
+	if contentType == "" {
+		return nil, false
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil, false
+	}
+	fn, ok := reg.decoders[mediaType]
+	return fn, ok
+}
+
+// StreamEvent is one decoded item from a Stream, or the error that ended it
+type StreamEvent[T any] struct {
+	Data T
+	Err  error
+}
+
+// Stream represents an in-flight streaming request started by DoStream
+type Stream[T any] struct {
+	events chan StreamEvent[T]
+	cancel context.CancelFunc
+}
+
+// ResultChan returns the channel of decoded events
+// It is closed when the stream ends, whether because the server closed the connection, the
+// decoder returned an error, or Stop was called. The last event carries the terminal error, if any
+func (s *Stream[T]) ResultChan() <-chan StreamEvent[T] {
+	return s.events
+}
+
+// Stop ends the stream, cancelling its context, which aborts the underlying request and closes
+// the response body
+func (s *Stream[T]) Stop() {
+	s.cancel()
+}
+
+// StreamDecoder decodes one item at a time out of a long-lived response body
+// Decode is called repeatedly by DoStream, always with the same reader and the same decoder
+// instance, so a StreamDecoder is free to keep state (such as a *bufio.Reader) between calls
+// It returns io.EOF to signal a clean end of stream, or any other error to abort it
+type StreamDecoder interface {
+	Decode(r io.Reader, out any) error
+}
+
+// WithStream sets the decoder used by DoStream
+func WithStream(dec StreamDecoder) Option {
+	return func(r *Builder) {
+		r.StreamDecoder = dec
+	}
+}
+
+// NDJSONDecoder decodes a newline-delimited JSON stream, one JSON value per line
+type NDJSONDecoder struct {
+	scanner *bufio.Scanner
+}
+
+// Decode reads the next line and json.Unmarshals it into out
+func (d *NDJSONDecoder) Decode(r io.Reader, out any) error {
+	if d.scanner == nil {
+		d.scanner = bufio.NewScanner(r)
 	}
-	return body, nil
+	if !d.scanner.Scan() {
+		if err := d.scanner.Err(); err != nil {
+			return err
+		}
+		return io.EOF
+	}
+	return json.Unmarshal(d.scanner.Bytes(), out)
+}
+
+// LineDecoder decodes a stream of raw newline-terminated text, one line at a time
+type LineDecoder struct {
+	scanner *bufio.Scanner
+}
+
+// Decode reads the next line into out, which must be a *string
+func (d *LineDecoder) Decode(r io.Reader, out any) error {
+	if d.scanner == nil {
+		d.scanner = bufio.NewScanner(r)
+	}
+	dst, ok := out.(*string)
+	if !ok {
+		return fmt.Errorf("httprequest: LineDecoder needs a *string, got %T", out)
+	}
+	if !d.scanner.Scan() {
+		if err := d.scanner.Err(); err != nil {
+			return err
+		}
+		return io.EOF
+	}
+	*dst = d.scanner.Text()
+	return nil
+}
+
+// SSEEvent holds one event parsed out of a Server-Sent Events stream
+type SSEEvent struct {
+	Event string
+	ID    string
+	Data  string
+}
+
+// SSEDecoder decodes a Server-Sent Events stream per the SSE spec, emitting one SSEEvent per
+// blank-line-terminated block
+type SSEDecoder struct {
+	r       *bufio.Reader
+	pending error
+}
+
+// Decode reads the next event block into out, which must be a *SSEEvent
+func (d *SSEDecoder) Decode(r io.Reader, out any) error {
+	if d.r == nil {
+		d.r = bufio.NewReader(r)
+	}
+	dst, ok := out.(*SSEEvent)
+	if !ok {
+		return fmt.Errorf("httprequest: SSEDecoder needs a *SSEEvent, got %T", out)
+	}
+	if d.pending != nil {
+		err := d.pending
+		d.pending = nil
+		return err
+	}
+
+	var ev SSEEvent
+	sawField := false
+	for {
+		line, readErr := d.r.ReadString('\n')
+		field := strings.TrimRight(line, "\r\n")
+
+		if field != "" {
+			switch {
+			case strings.HasPrefix(field, ":"):
+				// comment line, used by real servers for keep-alive pings; ignored per the SSE spec
+			case strings.HasPrefix(field, "event:"):
+				sawField = true
+				ev.Event = strings.TrimPrefix(strings.TrimPrefix(field, "event:"), " ")
+			case strings.HasPrefix(field, "id:"):
+				sawField = true
+				ev.ID = strings.TrimPrefix(strings.TrimPrefix(field, "id:"), " ")
+			case strings.HasPrefix(field, "data:"):
+				sawField = true
+				data := strings.TrimPrefix(strings.TrimPrefix(field, "data:"), " ")
+				if ev.Data != "" {
+					ev.Data += "\n"
+				}
+				ev.Data += data
+			}
+		}
+
+		if readErr != nil {
+			if sawField {
+				d.pending = readErr
+				*dst = ev
+				return nil
+			}
+			return readErr
+		}
+		if field == "" && sawField {
+			*dst = ev
+			return nil
+		}
+	}
+}
+
+// DoStream performs a request and decodes its response body as a long-lived stream, one item at
+// a time, via b.StreamDecoder (a LineDecoder by default). Unlike Do, the response body is never
+// fully buffered, which makes it usable against newline-delimited JSON APIs, Server-Sent Events
+// and other chunked, long-lived responses
+func DoStream[T any](b Builder) (*Stream[T], error) {
+	ctx, cancel := context.WithCancel(b.Context)
+	b.Context = ctx
+
+	request, err := b.Build()
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	response, err := b.roundTrip(request)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	statusOK := response.StatusCode >= 200 && response.StatusCode < 300
+	if !statusOK {
+		cancel()
+		_ = response.Body.Close()
+		return nil, fmt.Errorf("httprequest: stream request failed with status %d", response.StatusCode)
+	}
+
+	dec := b.StreamDecoder
+	if dec == nil {
+		dec = &LineDecoder{}
+	}
+
+	s := &Stream[T]{
+		events: make(chan StreamEvent[T]),
+		cancel: cancel,
+	}
+
+	go func() {
+		defer close(s.events)
+		defer response.Body.Close()
+
+		for {
+			var item T
+			decErr := dec.Decode(response.Body, &item)
+			if decErr != nil {
+				if decErr != io.EOF {
+					select {
+					case s.events <- StreamEvent[T]{Err: decErr}:
+					case <-ctx.Done():
+					}
+				}
+				return
+			}
+
+			select {
+			case s.events <- StreamEvent[T]{Data: item}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return s, nil
 }
 
 // Ctx specify the context for the Builder
@@ -199,11 +630,12 @@ func Method(method string) Option {
 // Path sets the path
 // To set path params, use :{value}
 // Example:
-// 			...
-// 			Path("/:userId/address/:addId")
-//			Param("userId", "123")
-//			Param("addId", "2")
-// 			...
+//
+//	...
+//	Path("/:userId/address/:addId")
+//	Param("userId", "123")
+//	Param("addId", "2")
+//	...
 func Path(path string) Option {
 	return func(r *Builder) {
 		r.Path = path
@@ -229,13 +661,14 @@ func Params(params map[string]interface{}) Option {
 // Header adds to the header a value
 // The header name will always be first letter Upper
 // Example:
-// 			...
-// 			WithHeader("authoRIZATION", "someHASH")
-// 			WithHeader("content-tyPE", "someContent")
-// 			...
-//     this will end up as a header:
-//			Authorization: someHASH
-//			Content-Type:  someContent
+//
+//				...
+//				Header("authoRIZATION", "someHASH")
+//				Header("content-tyPE", "someContent")
+//				...
+//	    this will end up as a header:
+//				Authorization: someHASH
+//				Content-Type:  someContent
 func Header(key string, value interface{}) Option {
 	return func(r *Builder) {
 		r.Headers.Add(key, fmt.Sprint(value))
@@ -270,10 +703,30 @@ func Encoder(f EncoderFunc) Option {
 	}
 }
 
-// Decoder sets the decoder
-func Decoder(f EncoderFunc) Option {
+// Decoder sets the fallback decoder, used when the response's Content-Type does not match any
+// decoder registered in Decoders
+func Decoder(f DecoderFunc) Option {
 	return func(r *Builder) {
-		r.Encoder = f
+		r.Decoder = f
+	}
+}
+
+// RegisterDecoder registers fn as the decoder used for responses with the given media type
+func RegisterDecoder(mediaType string, fn DecoderFunc) Option {
+	return func(r *Builder) {
+		r.Decoders.RegisterDecoder(mediaType, fn)
+	}
+}
+
+// Accept sets the Accept header
+// If no mediaTypes are given, it is built from every media type registered in the Builder's
+// DecoderRegistry, so the server is told about everything the Builder can decode
+func Accept(mediaTypes ...string) Option {
+	return func(r *Builder) {
+		if len(mediaTypes) == 0 {
+			mediaTypes = r.Decoders.MediaTypes()
+		}
+		r.Headers.Set("Accept", strings.Join(mediaTypes, ", "))
 	}
 }
 
@@ -287,9 +740,8 @@ func Body(body any) Option {
 // String sets the body as a string
 func String(body string) Option {
 	return func(r *Builder) {
-		r.Body = bytes.NewBufferString(body)
-		r.Encoder = func(any) ([]byte, error) {
-			return []byte(body), nil
+		r.BodyProvider = func() (io.Reader, string, error) {
+			return strings.NewReader(body), "", nil
 		}
 	}
 }
@@ -298,9 +750,14 @@ func String(body string) Option {
 // This method already sets the Content-Type header as application/json
 func JSON(body interface{}) Option {
 	return func(r *Builder) {
-		r.Body = body
-		r.Encoder = json.Marshal
 		r.Headers.Add("Content-Type", "application/json")
+		r.BodyProvider = func() (io.Reader, string, error) {
+			encoded, err := json.Marshal(body)
+			if err != nil {
+				return nil, "", err
+			}
+			return bytes.NewReader(encoded), "", nil
+		}
 	}
 }
 
@@ -308,8 +765,360 @@ func JSON(body interface{}) Option {
 // This method already sets the Content-Type header as application/xml
 func XML(body interface{}) Option {
 	return func(r *Builder) {
-		r.Body = body
-		r.Encoder = xml.Marshal
 		r.Headers.Add("Content-Type", "application/xml")
+		r.BodyProvider = func() (io.Reader, string, error) {
+			encoded, err := xml.Marshal(body)
+			if err != nil {
+				return nil, "", err
+			}
+			return bytes.NewReader(encoded), "", nil
+		}
+	}
+}
+
+// Form sets the body as application/x-www-form-urlencoded
+// This method already sets the Content-Type header as application/x-www-form-urlencoded
+func Form(values url.Values) Option {
+	return func(r *Builder) {
+		r.Headers.Add("Content-Type", "application/x-www-form-urlencoded")
+		r.BodyProvider = func() (io.Reader, string, error) {
+			return strings.NewReader(values.Encode()), "", nil
+		}
+	}
+}
+
+// Multipart sets the body as multipart/form-data, streaming the parts written by build straight
+// into the request body through an io.Pipe so large files don't need to be buffered in memory.
+// This method already sets the Content-Type header with the writer's boundary.
+// Use FormField, FormFile and FormFileFromPath inside build to write the parts
+func Multipart(build func(*multipart.Writer) error) Option {
+	return func(r *Builder) {
+		r.BodyProvider = func() (io.Reader, string, error) {
+			pr, pw := io.Pipe()
+			w := multipart.NewWriter(pw)
+			contentType := w.FormDataContentType()
+
+			go func() {
+				err := build(w)
+				if err == nil {
+					err = w.Close()
+				}
+				_ = pw.CloseWithError(err)
+			}()
+
+			return pr, contentType, nil
+		}
+	}
+}
+
+// FormField writes name and value as a form field on w
+// Meant to be called from the build func passed to Multipart
+func FormField(w *multipart.Writer, name, value string) error {
+	return w.WriteField(name, value)
+}
+
+// FormFile creates a form file field named field with filename on w and copies r into it
+// Meant to be called from the build func passed to Multipart
+func FormFile(w *multipart.Writer, field, filename string, r io.Reader) error {
+	part, err := w.CreateFormFile(field, filename)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(part, r)
+	return err
+}
+
+// FormFileFromPath opens the file at path and writes it as a form file field named field on w,
+// using the file's base name as the filename
+// Meant to be called from the build func passed to Multipart
+func FormFileFromPath(w *multipart.Writer, field, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return FormFile(w, field, filepath.Base(path), f)
+}
+
+// Retry sets the policy used by Do to retry failed attempts
+func Retry(policy RetryPolicy) Option {
+	return func(r *Builder) {
+		r.Retry = policy
+	}
+}
+
+// RetryPolicy decides whether Do should retry a failed attempt
+// attempt is the number of the attempt that just finished, starting at 1
+// resp is nil when err is non-nil, since a transport error never produces a response
+// The returned time.Duration is how long Do should wait before the next attempt
+type RetryPolicy interface {
+	ShouldRetry(attempt int, resp *http.Response, err error) (bool, time.Duration)
+}
+
+// RetryPolicyFunc adapts a plain function to a RetryPolicy
+type RetryPolicyFunc func(attempt int, resp *http.Response, err error) (bool, time.Duration)
+
+// ShouldRetry calls f
+func (f RetryPolicyFunc) ShouldRetry(attempt int, resp *http.Response, err error) (bool, time.Duration) {
+	return f(attempt, resp, err)
+}
+
+// defaultRetryableStatuses are the status codes FixedBackoff and ExponentialBackoff treat
+// as transient, on top of any transport error
+var defaultRetryableStatuses = map[int]bool{
+	http.StatusTooManyRequests:    true,
+	http.StatusBadGateway:         true,
+	http.StatusServiceUnavailable: true,
+	http.StatusGatewayTimeout:     true,
+}
+
+func isRetryable(resp *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	return resp != nil && defaultRetryableStatuses[resp.StatusCode]
+}
+
+// FixedBackoff builds a RetryPolicy that allows up to maxAttempts attempts in total, waiting delay between
+// each attempt. It retries on transport errors and on the default set of transient status codes
+// (429, 502, 503, 504)
+func FixedBackoff(maxAttempts int, delay time.Duration) RetryPolicy {
+	return RetryPolicyFunc(func(attempt int, resp *http.Response, err error) (bool, time.Duration) {
+		if attempt >= maxAttempts || !isRetryable(resp, err) {
+			return false, 0
+		}
+		return true, delay
+	})
+}
+
+// ExponentialBackoff builds a RetryPolicy that allows up to maxAttempts attempts in total, doubling the delay
+// on each attempt starting from base and never going over cap. jitter, between 0 and 1, adds up to
+// jitter*delay of random jitter on top, to avoid many callers retrying in lockstep.
+// It retries on transport errors and on the default set of transient status codes (429, 502, 503, 504)
+func ExponentialBackoff(maxAttempts int, base, cap time.Duration, jitter float64) RetryPolicy {
+	return RetryPolicyFunc(func(attempt int, resp *http.Response, err error) (bool, time.Duration) {
+		if attempt >= maxAttempts || !isRetryable(resp, err) {
+			return false, 0
+		}
+		delay := base << uint(attempt-1)
+		if delay <= 0 || delay > cap {
+			delay = cap
+		}
+		if jitter > 0 {
+			delay += time.Duration(jitter * float64(delay) * rand.Float64())
+		}
+		return true, delay
+	})
+}
+
+// RetryOnStatuses builds a RetryPolicy that retries, with no delay and no attempt limit of its own,
+// whenever the response status matches one of codes. It is meant to be used on its own for simple
+// status-based retries; pair it with FixedBackoff or ExponentialBackoff in a custom RetryPolicy when
+// both a status filter and a backoff are needed
+func RetryOnStatuses(codes ...int) RetryPolicy {
+	set := make(map[int]bool, len(codes))
+	for _, c := range codes {
+		set[c] = true
+	}
+	return RetryPolicyFunc(func(attempt int, resp *http.Response, err error) (bool, time.Duration) {
+		return resp != nil && set[resp.StatusCode], 0
+	})
+}
+
+// Use appends mw to the Builder's Middlewares; the first one added is the outermost, so each
+// wraps the ones added after it
+func Use(mw ...Middleware) Option {
+	return func(r *Builder) {
+		r.Middlewares = append(r.Middlewares, mw...)
+	}
+}
+
+// Logger is the logging interface used by LoggingMiddleware, satisfied by *log.Logger among others
+type Logger interface {
+	Printf(format string, args ...any)
+}
+
+// LoggingMiddleware logs the method, URL, outcome and duration of every request
+func LoggingMiddleware(logger Logger) Middleware {
+	return func(next RoundTripFunc) RoundTripFunc {
+		return func(req *http.Request) (*http.Response, error) {
+			start := time.Now()
+			resp, err := next(req)
+			dur := time.Since(start)
+			if err != nil {
+				logger.Printf("httprequest: %s %s failed after %s: %v", req.Method, req.URL, dur, err)
+				return resp, err
+			}
+			logger.Printf("httprequest: %s %s -> %d in %s", req.Method, req.URL, resp.StatusCode, dur)
+			return resp, err
+		}
+	}
+}
+
+// HeaderInjector calls inject on every request before it is sent, which is useful for things like
+// refreshing an auth token on every attempt rather than once at Build time
+func HeaderInjector(inject func(*http.Request)) Middleware {
+	return func(next RoundTripFunc) RoundTripFunc {
+		return func(req *http.Request) (*http.Response, error) {
+			inject(req)
+			return next(req)
+		}
+	}
+}
+
+// MetricsMiddleware reports the method, path, status and duration of every request to record
+// A failed request, where no response was received, reports status 0
+func MetricsMiddleware(record func(method, path string, status int, dur time.Duration)) Middleware {
+	return func(next RoundTripFunc) RoundTripFunc {
+		return func(req *http.Request) (*http.Response, error) {
+			start := time.Now()
+			resp, err := next(req)
+			status := 0
+			if resp != nil {
+				status = resp.StatusCode
+			}
+			record(req.Method, req.URL.Path, status, time.Since(start))
+			return resp, err
+		}
+	}
+}
+
+// Limiter throttles outgoing requests
+// Wait blocks until the caller is allowed to proceed, or returns ctx's error if it is done first
+type Limiter interface {
+	Wait(ctx context.Context) error
+}
+
+// RateLimit sets the Limiter that Do waits on before dispatching the request, and again before
+// every retry attempt
+func RateLimit(l Limiter) Option {
+	return func(r *Builder) {
+		r.Limiter = l
+	}
+}
+
+// TokenBucketLimiter is a Limiter backed by golang.org/x/time/rate, enforcing a steady requests
+// per second rate with bursts of up to burst requests
+type TokenBucketLimiter struct {
+	limiter *rate.Limiter
+}
+
+// NewTokenBucketLimiter builds a TokenBucketLimiter allowing requestsPerSecond requests per
+// second on average, with bursts of up to burst requests
+func NewTokenBucketLimiter(requestsPerSecond float64, burst int) *TokenBucketLimiter {
+	return &TokenBucketLimiter{limiter: rate.NewLimiter(rate.Limit(requestsPerSecond), burst)}
+}
+
+// Wait blocks until a token is available, or ctx is done
+func (l *TokenBucketLimiter) Wait(ctx context.Context) error {
+	return l.limiter.Wait(ctx)
+}
+
+// AdaptiveLimiter is a Limiter that starts at an initial rate and halves it whenever its
+// Middleware observes a 429 response, dropping straight to its minimum rate when the server asks
+// for a long wait via Retry-After or X-RateLimit-Reset. It expands back towards the initial rate
+// after a run of consecutive non-429 responses. AdaptiveLimiter is safe for concurrent use, so a
+// single instance can be shared across every Builder calling a given service to enforce one
+// quota, the same way a client-go rest.Client shares its flowcontrol.RateLimiter
+type AdaptiveLimiter struct {
+	mu          sync.Mutex
+	limiter     *rate.Limiter
+	initialRate rate.Limit
+	minRate     rate.Limit
+	successes   int
+}
+
+// NewAdaptiveLimiter builds an AdaptiveLimiter starting at requestsPerSecond, never shrinking
+// below minRequestsPerSecond, with bursts of up to burst requests
+func NewAdaptiveLimiter(requestsPerSecond, minRequestsPerSecond float64, burst int) *AdaptiveLimiter {
+	return &AdaptiveLimiter{
+		limiter:     rate.NewLimiter(rate.Limit(requestsPerSecond), burst),
+		initialRate: rate.Limit(requestsPerSecond),
+		minRate:     rate.Limit(minRequestsPerSecond),
+	}
+}
+
+// Wait blocks until a token is available at the current rate, or ctx is done
+func (l *AdaptiveLimiter) Wait(ctx context.Context) error {
+	l.mu.Lock()
+	limiter := l.limiter
+	l.mu.Unlock()
+	return limiter.Wait(ctx)
+}
+
+// Middleware observes the responses flowing through it, shrinking the rate whenever it sees a
+// 429 and expanding it back towards the initial rate after expandAfter consecutive non-429
+// responses
+func (l *AdaptiveLimiter) Middleware(expandAfter int) Middleware {
+	return func(next RoundTripFunc) RoundTripFunc {
+		return func(req *http.Request) (*http.Response, error) {
+			resp, err := next(req)
+			if err != nil {
+				return resp, err
+			}
+			if resp.StatusCode == http.StatusTooManyRequests {
+				l.shrink(resp)
+			} else {
+				l.expand(expandAfter)
+			}
+			return resp, err
+		}
+	}
+}
+
+func (l *AdaptiveLimiter) shrink(resp *http.Response) {
+	wait := time.Duration(0)
+	if d, ok := retryAfter(resp); ok {
+		wait = d
+	} else if reset, ok := rateLimitReset(resp); ok {
+		wait = time.Until(reset)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.successes = 0
+
+	next := l.limiter.Limit() / 2
+	if wait > 10*time.Second {
+		next = l.minRate
+	}
+	if next < l.minRate {
+		next = l.minRate
+	}
+	l.limiter.SetLimit(next)
+}
+
+func (l *AdaptiveLimiter) expand(expandAfter int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.limiter.Limit() >= l.initialRate {
+		return
+	}
+	l.successes++
+	if l.successes < expandAfter {
+		return
+	}
+	l.successes = 0
+
+	next := l.limiter.Limit() * 2
+	if next > l.initialRate {
+		next = l.initialRate
+	}
+	l.limiter.SetLimit(next)
+}
+
+// rateLimitReset reads the X-RateLimit-Reset header, interpreted as a Unix timestamp in seconds,
+// as sent by GitHub and many similar APIs
+func rateLimitReset(resp *http.Response) (time.Time, bool) {
+	v := resp.Header.Get("X-RateLimit-Reset")
+	if v == "" {
+		return time.Time{}, false
+	}
+	seconds, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return time.Time{}, false
 	}
+	return time.Unix(seconds, 0), true
 }
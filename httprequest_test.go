@@ -1,13 +1,21 @@
 package httprequest
 
 import (
+	"context"
 	"encoding/json"
 	"encoding/xml"
+	"io"
 	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 const host = "http://defaultHost"
@@ -382,3 +390,676 @@ func TestNewRequestError(t *testing.T) {
 		t.FailNow()
 	}
 }
+
+func TestNewForm(t *testing.T) {
+	values := url.Values{
+		"field": {"value"},
+	}
+	r, err := NewBuilder(host,
+		Form(values),
+	).Build()
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	all, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	if string(all) != values.Encode() {
+		t.Errorf("final body does not match: expected %s, result: %s", values.Encode(), string(all))
+		t.FailNow()
+	}
+
+	if r.Header.Get("Content-Type") != "application/x-www-form-urlencoded" {
+		t.Errorf("final header does not match: expected %s, result: %s", "application/x-www-form-urlencoded", r.Header.Get("Content-Type"))
+		t.FailNow()
+	}
+}
+
+func TestNewMultipart(t *testing.T) {
+	field := "field"
+	value := "value"
+	fileField := "file"
+	fileName := "a.txt"
+	fileContent := "fileContent"
+
+	r, err := NewBuilder(host,
+		Multipart(func(w *multipart.Writer) error {
+			if err := FormField(w, field, value); err != nil {
+				return err
+			}
+			return FormFile(w, fileField, fileName, strings.NewReader(fileContent))
+		}),
+	).Build()
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	mediaType, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	if mediaType != "multipart/form-data" {
+		t.Errorf("final content type does not match: expected %s, result: %s", "multipart/form-data", mediaType)
+		t.FailNow()
+	}
+
+	mr := multipart.NewReader(r.Body, params["boundary"])
+
+	part, err := mr.NextPart()
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	if part.FormName() != field {
+		t.Errorf("final field name does not match: expected %s, result: %s", field, part.FormName())
+		t.FailNow()
+	}
+	all, _ := ioutil.ReadAll(part)
+	if string(all) != value {
+		t.Errorf("final field value does not match: expected %s, result: %s", value, string(all))
+		t.FailNow()
+	}
+
+	part, err = mr.NextPart()
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	if part.FormName() != fileField {
+		t.Errorf("final file field name does not match: expected %s, result: %s", fileField, part.FormName())
+		t.FailNow()
+	}
+	if part.FileName() != fileName {
+		t.Errorf("final file name does not match: expected %s, result: %s", fileName, part.FileName())
+		t.FailNow()
+	}
+	all, _ = ioutil.ReadAll(part)
+	if string(all) != fileContent {
+		t.Errorf("final file content does not match: expected %s, result: %s", fileContent, string(all))
+		t.FailNow()
+	}
+}
+
+func TestParseResponseNegotiatesContentType(t *testing.T) {
+	type body struct {
+		Field string `json:"field" xml:"field"`
+	}
+
+	xmlResp := &http.Response{
+		Header: http.Header{"Content-Type": {"application/xml; charset=utf-8"}},
+		Body:   ioutil.NopCloser(strings.NewReader(`<body><field>fromXML</field></body>`)),
+	}
+
+	got, err := ParseResponse[body](xmlResp, NewDecoderRegistry(), json.Unmarshal)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	if got.Field != "fromXML" {
+		t.Errorf("expected the xml decoder to run based on Content-Type, got %+v", got)
+		t.FailNow()
+	}
+}
+
+func TestParseResponseFallsBackToDefault(t *testing.T) {
+	type body struct {
+		Field string `json:"field"`
+	}
+
+	resp := &http.Response{
+		Header: http.Header{"Content-Type": {"application/vnd.custom+json"}},
+		Body:   ioutil.NopCloser(strings.NewReader(`{"field":"fromDefault"}`)),
+	}
+
+	got, err := ParseResponse[body](resp, NewDecoderRegistry(), json.Unmarshal)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	if got.Field != "fromDefault" {
+		t.Errorf("expected the default decoder to run for an unregistered media type, got %+v", got)
+		t.FailNow()
+	}
+}
+
+func TestParseResponseTextPlain(t *testing.T) {
+	resp := &http.Response{
+		Header: http.Header{"Content-Type": {"text/plain"}},
+		Body:   ioutil.NopCloser(strings.NewReader("plain body")),
+	}
+
+	got, err := ParseResponse[string](resp, NewDecoderRegistry(), nil)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	if got != "plain body" {
+		t.Errorf("final body does not match: expected %s, result: %s", "plain body", got)
+		t.FailNow()
+	}
+}
+
+func TestNewAcceptExplicit(t *testing.T) {
+	r, err := NewBuilder(host, Accept("application/json", "application/xml")).Build()
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	expected := "application/json, application/xml"
+	if r.Header.Get("Accept") != expected {
+		t.Errorf("final header does not match: expected %s, result: %s", expected, r.Header.Get("Accept"))
+		t.FailNow()
+	}
+}
+
+func TestNewAcceptFromRegistry(t *testing.T) {
+	r, err := NewBuilder(host, Accept()).Build()
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	accept := r.Header.Get("Accept")
+	for _, mt := range []string{"application/json", "application/xml", "text/plain"} {
+		if !strings.Contains(accept, mt) {
+			t.Errorf("expected Accept to contain %s, result: %s", mt, accept)
+			t.FailNow()
+		}
+	}
+}
+
+func TestDoMiddlewareChainOrder(t *testing.T) {
+	var order []string
+	mw := func(name string) Middleware {
+		return func(next RoundTripFunc) RoundTripFunc {
+			return func(req *http.Request) (*http.Response, error) {
+				order = append(order, name+":before")
+				resp, err := next(req)
+				order = append(order, name+":after")
+				return resp, err
+			}
+		}
+	}
+
+	cli := clientFunc(func(r *http.Request) (*http.Response, error) {
+		order = append(order, "call")
+		return statusResponse(http.StatusOK), nil
+	})
+
+	Do[any](*NewBuilder(host, Cli(cli), Use(mw("outer"), mw("inner"))))
+
+	expected := []string{"outer:before", "inner:before", "call", "inner:after", "outer:after"}
+	if len(order) != len(expected) {
+		t.Errorf("expected order %v, got %v", expected, order)
+		t.FailNow()
+	}
+	for i := range expected {
+		if order[i] != expected[i] {
+			t.Errorf("expected order %v, got %v", expected, order)
+			t.FailNow()
+		}
+	}
+}
+
+func TestDoHeaderInjector(t *testing.T) {
+	var gotAuth string
+	cli := clientFunc(func(r *http.Request) (*http.Response, error) {
+		gotAuth = r.Header.Get("Authorization")
+		return statusResponse(http.StatusOK), nil
+	})
+
+	Do[any](*NewBuilder(host, Cli(cli), Use(HeaderInjector(func(req *http.Request) {
+		req.Header.Set("Authorization", "Bearer token")
+	}))))
+
+	if gotAuth != "Bearer token" {
+		t.Errorf("expected injected header, got %s", gotAuth)
+		t.FailNow()
+	}
+}
+
+func TestDoMetricsMiddleware(t *testing.T) {
+	var gotMethod, gotPath string
+	var gotStatus int
+	cli := clientFunc(func(r *http.Request) (*http.Response, error) {
+		return statusResponse(http.StatusTeapot), nil
+	})
+
+	Do[any](*NewBuilder(host, Path("/brew"), Cli(cli), Use(MetricsMiddleware(func(method, path string, status int, dur time.Duration) {
+		gotMethod = method
+		gotPath = path
+		gotStatus = status
+	}))))
+
+	if gotMethod != http.MethodGet || gotPath != "/brew" || gotStatus != http.StatusTeapot {
+		t.Errorf("unexpected metrics: method=%s path=%s status=%d", gotMethod, gotPath, gotStatus)
+		t.FailNow()
+	}
+}
+
+func TestNDJSONDecoder(t *testing.T) {
+	type line struct {
+		Field string `json:"field"`
+	}
+	r := strings.NewReader("{\"field\":\"a\"}\n{\"field\":\"b\"}\n")
+	dec := &NDJSONDecoder{}
+
+	var first, second line
+	if err := dec.Decode(r, &first); err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	if err := dec.Decode(r, &second); err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	if first.Field != "a" || second.Field != "b" {
+		t.Errorf("unexpected decoded values: %+v %+v", first, second)
+		t.FailNow()
+	}
+
+	var third line
+	if err := dec.Decode(r, &third); err != io.EOF {
+		t.Errorf("expected io.EOF, got %v", err)
+		t.FailNow()
+	}
+}
+
+func TestLineDecoder(t *testing.T) {
+	r := strings.NewReader("first\nsecond\n")
+	dec := &LineDecoder{}
+
+	var first, second string
+	if err := dec.Decode(r, &first); err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	if err := dec.Decode(r, &second); err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	if first != "first" || second != "second" {
+		t.Errorf("unexpected decoded values: %q %q", first, second)
+		t.FailNow()
+	}
+}
+
+func TestSSEDecoder(t *testing.T) {
+	r := strings.NewReader("event: greeting\ndata: hello\ndata: world\n\nevent: bye\ndata: done\n\n")
+	dec := &SSEDecoder{}
+
+	var first, second SSEEvent
+	if err := dec.Decode(r, &first); err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	if err := dec.Decode(r, &second); err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	if first.Event != "greeting" || first.Data != "hello\nworld" {
+		t.Errorf("unexpected first event: %+v", first)
+		t.FailNow()
+	}
+	if second.Event != "bye" || second.Data != "done" {
+		t.Errorf("unexpected second event: %+v", second)
+		t.FailNow()
+	}
+}
+
+func TestSSEDecoderIgnoresCommentOnlyBlock(t *testing.T) {
+	r := strings.NewReader(": keep-alive\n\nevent: real\ndata: value\n\n")
+	dec := &SSEDecoder{}
+
+	var ev SSEEvent
+	if err := dec.Decode(r, &ev); err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	if ev.Event != "real" || ev.Data != "value" {
+		t.Errorf("expected the comment-only block to be skipped, got %+v", ev)
+		t.FailNow()
+	}
+}
+
+func TestDoStreamNDJSON(t *testing.T) {
+	type line struct {
+		Field string `json:"field"`
+	}
+	cli := clientFunc(func(r *http.Request) (*http.Response, error) {
+		resp := statusResponse(http.StatusOK)
+		resp.Body = ioutil.NopCloser(strings.NewReader("{\"field\":\"a\"}\n{\"field\":\"b\"}\n"))
+		return resp, nil
+	})
+
+	s, err := DoStream[line](*NewBuilder(host, Cli(cli), WithStream(&NDJSONDecoder{})))
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	var got []string
+	for ev := range s.ResultChan() {
+		if ev.Err != nil {
+			t.Error(ev.Err)
+			t.FailNow()
+		}
+		got = append(got, ev.Data.Field)
+	}
+
+	if len(got) != 2 || got[0] != "a" || got[1] != "b" {
+		t.Errorf("unexpected stream events: %v", got)
+		t.FailNow()
+	}
+}
+
+func TestDoStreamStop(t *testing.T) {
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	cli := clientFunc(func(r *http.Request) (*http.Response, error) {
+		resp := statusResponse(http.StatusOK)
+		resp.Body = pr
+		// a real Client's RoundTripper aborts the read when the request's context is cancelled;
+		// emulate that here so Stop can actually unblock the stream goroutine
+		go func() {
+			<-r.Context().Done()
+			pr.Close()
+		}()
+		return resp, nil
+	})
+
+	s, err := DoStream[string](*NewBuilder(host, Cli(cli)))
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	s.Stop()
+
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case _, ok := <-s.ResultChan():
+			if !ok {
+				return
+			}
+		case <-timeout:
+			t.Error("expected the result channel to be closed after Stop")
+			t.FailNow()
+		}
+	}
+}
+
+type errLimiter struct{ err error }
+
+func (l errLimiter) Wait(ctx context.Context) error { return l.err }
+
+func TestDoRateLimitErrorStopsBeforeDispatch(t *testing.T) {
+	calls := 0
+	cli := clientFunc(func(r *http.Request) (*http.Response, error) {
+		calls++
+		return statusResponse(http.StatusOK), nil
+	})
+
+	limitErr := context.Canceled
+	resp := Do[any](*NewBuilder(host, Cli(cli), RateLimit(errLimiter{err: limitErr})))
+
+	if calls != 0 {
+		t.Errorf("expected the request never to be dispatched, got %d calls", calls)
+		t.FailNow()
+	}
+	if resp.Err != limitErr {
+		t.Errorf("expected the limiter's error, got %v", resp.Err)
+		t.FailNow()
+	}
+}
+
+func TestDoRateLimitWaitsEachRetry(t *testing.T) {
+	waits := 0
+	cli := clientFunc(func(r *http.Request) (*http.Response, error) {
+		return statusResponse(http.StatusServiceUnavailable), nil
+	})
+
+	maxAttempts := 3
+	Do[any](*NewBuilder(host,
+		Cli(cli),
+		Retry(FixedBackoff(maxAttempts, time.Millisecond)),
+		RateLimit(limiterFunc(func(ctx context.Context) error {
+			waits++
+			return nil
+		})),
+	))
+
+	if waits != maxAttempts {
+		t.Errorf("expected the limiter to be waited on once per attempt, expected %d, got %d", maxAttempts, waits)
+		t.FailNow()
+	}
+}
+
+type limiterFunc func(ctx context.Context) error
+
+func (f limiterFunc) Wait(ctx context.Context) error { return f(ctx) }
+
+func TestTokenBucketLimiterWaits(t *testing.T) {
+	l := NewTokenBucketLimiter(1000, 1)
+
+	if err := l.Wait(context.Background()); err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+}
+
+func TestAdaptiveLimiterShrinksAndExpands(t *testing.T) {
+	l := NewAdaptiveLimiter(100, 1, 1)
+	mw := l.Middleware(2)
+
+	call := mw(func(req *http.Request) (*http.Response, error) {
+		return statusResponse(http.StatusTooManyRequests), nil
+	})
+	req, _ := http.NewRequest(http.MethodGet, host, nil)
+	if _, err := call(req); err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	shrunk := l.limiter.Limit()
+	if float64(shrunk) >= 100 {
+		t.Errorf("expected the rate to shrink below the initial rate, got %v", shrunk)
+		t.FailNow()
+	}
+
+	okCall := mw(func(req *http.Request) (*http.Response, error) {
+		return statusResponse(http.StatusOK), nil
+	})
+	for i := 0; i < 2; i++ {
+		if _, err := okCall(req); err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
+	}
+
+	if float64(l.limiter.Limit()) <= float64(shrunk) {
+		t.Errorf("expected the rate to expand back up after consecutive successes, got %v", l.limiter.Limit())
+		t.FailNow()
+	}
+}
+
+// clientFunc adapts a plain function to a Client
+type clientFunc func(*http.Request) (*http.Response, error)
+
+func (f clientFunc) Do(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+func statusResponse(status int) *http.Response {
+	return &http.Response{
+		StatusCode: status,
+		Header:     make(http.Header),
+		Body:       ioutil.NopCloser(strings.NewReader("")),
+	}
+}
+
+func TestDoNoRetryByDefault(t *testing.T) {
+	calls := 0
+	cli := clientFunc(func(r *http.Request) (*http.Response, error) {
+		calls++
+		return statusResponse(http.StatusServiceUnavailable), nil
+	})
+
+	resp := Do[any](*NewBuilder(host, Cli(cli)))
+
+	if calls != 1 {
+		t.Errorf("expected 1 call, got %d", calls)
+		t.FailNow()
+	}
+	if resp.Attempts != 1 {
+		t.Errorf("expected 1 attempt, got %d", resp.Attempts)
+		t.FailNow()
+	}
+}
+
+func TestDoRetryFixedBackoffRecovers(t *testing.T) {
+	calls := 0
+	cli := clientFunc(func(r *http.Request) (*http.Response, error) {
+		calls++
+		if calls < 3 {
+			return statusResponse(http.StatusServiceUnavailable), nil
+		}
+		return statusResponse(http.StatusOK), nil
+	})
+
+	resp := Do[any](*NewBuilder(host, Cli(cli), Retry(FixedBackoff(5, time.Millisecond))))
+
+	if calls != 3 {
+		t.Errorf("expected 3 calls, got %d", calls)
+		t.FailNow()
+	}
+	if resp.Attempts != 3 {
+		t.Errorf("expected 3 attempts, got %d", resp.Attempts)
+		t.FailNow()
+	}
+	if resp.Status != http.StatusOK {
+		t.Errorf("expected status %d, got %d", http.StatusOK, resp.Status)
+		t.FailNow()
+	}
+}
+
+func TestDoRetryReusesConnection(t *testing.T) {
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls < 4 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			// a non-empty body is what exposes a leaked connection: net/http can't return a
+			// connection to the pool unless the previous response's body was read to EOF
+			_, _ = w.Write([]byte(strings.Repeat("unread body content ", 64)))
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	var conns int32
+	server.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&conns, 1)
+		}
+	}
+
+	resp := Do[any](*NewBuilder(server.URL, Retry(FixedBackoff(5, time.Millisecond))))
+
+	if resp.Status != http.StatusOK {
+		t.Errorf("expected status %d, got %d", http.StatusOK, resp.Status)
+		t.FailNow()
+	}
+	if calls != 4 {
+		t.Errorf("expected 4 calls, got %d", calls)
+		t.FailNow()
+	}
+	if got := atomic.LoadInt32(&conns); got != 1 {
+		t.Errorf("expected a single reused TCP connection across retries, got %d", got)
+		t.FailNow()
+	}
+}
+
+func TestDoRetryFixedBackoffGivesUp(t *testing.T) {
+	calls := 0
+	cli := clientFunc(func(r *http.Request) (*http.Response, error) {
+		calls++
+		return statusResponse(http.StatusServiceUnavailable), nil
+	})
+
+	maxAttempts := 3
+	resp := Do[any](*NewBuilder(host, Cli(cli), Retry(FixedBackoff(maxAttempts, time.Millisecond))))
+
+	if calls != maxAttempts {
+		t.Errorf("expected %d calls, got %d", maxAttempts, calls)
+		t.FailNow()
+	}
+	if resp.Attempts != maxAttempts {
+		t.Errorf("expected %d attempts, got %d", maxAttempts, resp.Attempts)
+		t.FailNow()
+	}
+	if resp.Status != http.StatusServiceUnavailable {
+		t.Errorf("expected status %d, got %d", http.StatusServiceUnavailable, resp.Status)
+		t.FailNow()
+	}
+}
+
+func TestDoRetryHonorsRetryAfter(t *testing.T) {
+	calls := 0
+	var firstCallAt time.Time
+	cli := clientFunc(func(r *http.Request) (*http.Response, error) {
+		calls++
+		if calls == 1 {
+			firstCallAt = time.Now()
+			resp := statusResponse(http.StatusTooManyRequests)
+			resp.Header.Set("Retry-After", "0")
+			return resp, nil
+		}
+		return statusResponse(http.StatusOK), nil
+	})
+
+	resp := Do[any](*NewBuilder(host, Cli(cli), Retry(FixedBackoff(5, time.Hour))))
+
+	if calls != 2 {
+		t.Errorf("expected 2 calls, got %d", calls)
+		t.FailNow()
+	}
+	if time.Since(firstCallAt) >= time.Hour {
+		t.Error("Retry-After should have overridden the policy's delay")
+		t.FailNow()
+	}
+	if resp.Status != http.StatusOK {
+		t.Errorf("expected status %d, got %d", http.StatusOK, resp.Status)
+		t.FailNow()
+	}
+}
+
+func TestDoRetryContextCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	calls := 0
+	cli := clientFunc(func(r *http.Request) (*http.Response, error) {
+		calls++
+		cancel()
+		return statusResponse(http.StatusServiceUnavailable), nil
+	})
+
+	resp := Do[any](*NewBuilder(host, Ctx(ctx), Cli(cli), Retry(FixedBackoff(5, time.Hour))))
+
+	if calls != 1 {
+		t.Errorf("expected 1 call, got %d", calls)
+		t.FailNow()
+	}
+	if resp.Err == nil {
+		t.Error("expected the cancelled context error to be returned")
+		t.FailNow()
+	}
+}